@@ -2,14 +2,18 @@ package boxtransport
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
-	"golang.org/x/crypto/nacl/box"
+	"io"
 	"net"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 /*
- This file defines the underlying BoxConn structure 
+ This file defines the underlying BoxConn structure
  and available functions not declared in an interface.
 */
 
@@ -21,77 +25,224 @@ type BoxConn struct {
 	outStream chan *writeRequest
 	outBox    chan []byte
 	inBox     chan []byte
-	errors    chan error
-	
+
+	// done is closed exactly once, either by Close or by the first
+	// fatal error any of the three worker goroutines hits, and is what
+	// every blocking select in this file (and in boxReader/boxWriter/
+	// streamWriter) waits on to know the connection is going away. wg
+	// lets Close block until all three have actually exited, and err
+	// is the sticky first error: once set it is never overwritten, so
+	// Write permanently fails with the original cause rather than
+	// whatever shutdown noise came after it.
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	err       error
+
 	// Settings
 	holdTime time.Duration
 
 	// Holds decrypted data to be read
 	plain bytes.Buffer
 
-	// Box keys
-	sharedSecret   *[32]byte
+	// Static keys
 	privateKey     *[32]byte
 	publicKey      *[32]byte
 	peersPublicKey *[32]byte
+
+	// Directional transport keys, derived from the Noise handshake's
+	// Split(). tx is used by seal, rx by unseal. The nonce for each
+	// direction is never sent on the wire: it is the strictly
+	// increasing frame counter below, so both peers stay in lockstep
+	// implicitly and a replayed or reordered frame simply fails to
+	// authenticate rather than needing an explicit check.
+	// txMu/rxMu serialize seal/unseal respectively: both are called
+	// from more than one place (seal from WriteFrame and streamWriter,
+	// unseal from ReadFrame), and WriteFrame/ReadFrame are exported
+	// with no documented single-caller requirement. Without this,
+	// concurrent callers race on the nonce counters below, which for
+	// an AEAD is not just a data race but a confidentiality break: two
+	// frames sealed under the same key and nonce leak their XOR.
+	txMu sync.Mutex
+	rxMu sync.Mutex
+	// sendMu is held by WriteFrame from seal until the sealed frame is
+	// queued on outBox, so concurrent WriteFrame calls queue their
+	// frames in the same order their nonces were drawn.
+	sendMu sync.Mutex
+
+	tx, rx        noiseKey
+	txNonce       uint64
+	rxNonce       uint64
+	handshakeHash []byte
+
+	// Rekeying: after rekeyInterval frames in a given direction, that
+	// direction's key is rotated via a BLAKE2s-based KDF over the
+	// current key and its nonce counter reset to 0. Both peers must
+	// configure the same interval, since each direction rekeys
+	// independently and deterministically.
+	rekeyInterval uint64
+	txFrames      uint64
+	rxFrames      uint64
 }
 
 const (
-	LenFieldSize = 2                                     // Length field size
-	NonceSize    = 24                                    // Size of box nonce
-	MaxRawData   = (1 << 16) - 1                         // Maximum raw data in frame (content + nonce + overhead)
-	MaxContent   = MaxRawData - box.Overhead - NonceSize // Maximum encrypted content in frame
+	LenFieldSize = 2                                      // Length field size
+	MaxRawData   = (1 << 16) - 1                          // Maximum raw data in frame (content + overhead)
+	MaxContent   = MaxRawData - chacha20poly1305.Overhead // Maximum encrypted content in frame
+
+	// defaultRekeyInterval is the number of frames sealed (or
+	// unsealed) under one derived key before BoxConn rotates it.
+	defaultRekeyInterval = 1 << 20
 )
 
+// Initiator opens conn and runs a Noise IK handshake as the
+// initiator, authenticating the remote party against peersPublicKey
+// (the "known responder" static key). peersPublicKey must not be nil:
+// the initiator always knows who it intends to talk to.
+func Initiator(conn net.Conn, publicKey, privateKey, peersPublicKey *[32]byte) (*BoxConn, error) {
+	if peersPublicKey == nil {
+		return nil, errors.New("Initiator must know the responder's public key")
+	}
+	return newBoxConn(conn, true, publicKey, privateKey, peersPublicKey)
+}
+
+// Responder opens conn and runs a Noise IK handshake as the
+// responder. peersPublicKey may be supplied to pin the initiator to a
+// known static key; if nil, the initiator's static key is accepted as
+// revealed during the handshake (the caller can inspect it afterwards
+// via PeersPublicKey).
+func Responder(conn net.Conn, publicKey, privateKey, peersPublicKey *[32]byte) (*BoxConn, error) {
+	return newBoxConn(conn, false, publicKey, privateKey, peersPublicKey)
+}
+
+// NewBoxConn is kept for backwards compatibility: it runs the
+// handshake as an initiator, matching the previous constructor's
+// default role.
+//
+// Deprecated: use Initiator or Responder instead.
+func NewBoxConn(conn net.Conn, publicKey, privateKey, peersPublicKey *[32]byte) (*BoxConn, error) {
+	return Initiator(conn, publicKey, privateKey, peersPublicKey)
+}
+
+func newBoxConn(conn net.Conn, initiator bool, publicKey, privateKey, peersPublicKey *[32]byte) (*BoxConn, error) {
+	if privateKey == nil {
+		return nil, errors.New("Local private key must be specified")
+	} else if publicKey == nil {
+		return nil, errors.New("Local public key must be specifed")
+	}
 
-// Wrap a connection in a new BoxTranport
-func NewBoxConn(conn net.Conn, publickey, privateKey, peersPublicKey *[32]byte) (*BoxConn, error) {
-	// Prepare buffers
 	c := &BoxConn{}
 	c.conn = conn
 	c.holdTime = time.Microsecond * 10
+	c.rekeyInterval = defaultRekeyInterval
+	c.privateKey = privateKey
+	c.publicKey = publicKey
+	c.peersPublicKey = peersPublicKey
+
+	hs, err := newNoiseHandshake(initiator, privateKey, publicKey, peersPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if initiator {
+		var version [2]byte
+		binary.BigEndian.PutUint16(version[:], noiseVersion)
+		if _, err := conn.Write(version[:]); err != nil {
+			return nil, err
+		}
+		msg1, err := hs.writeMessage1()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHandshakeMessage(conn, msg1); err != nil {
+			return nil, err
+		}
+		msg2, err := readHandshakeMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if err := hs.readMessage2(msg2); err != nil {
+			return nil, err
+		}
+	} else {
+		var version [2]byte
+		if _, err := io.ReadFull(conn, version[:]); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint16(version[:]) != noiseVersion {
+			return nil, errors.New("Unsupported handshake version")
+		}
+		msg1, err := readHandshakeMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if err := hs.readMessage1(msg1); err != nil {
+			return nil, err
+		}
+		msg2, err := hs.writeMessage2()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHandshakeMessage(conn, msg2); err != nil {
+			return nil, err
+		}
+		c.peersPublicKey = hs.rs
+	}
+
+	c.tx, c.rx, c.handshakeHash = hs.split()
 
 	// Prepare reader and writer
 	c.inBox = make(chan []byte)
 	c.outBox = make(chan []byte)
 	c.outStream = make(chan *writeRequest, 10)
-	c.errors = make(chan error, 5)
+	c.done = make(chan struct{})
+	c.wg.Add(3)
 	go c.boxReader()
 	go c.boxWriter()
 	go c.streamWriter()
 
-	// Prepare keys
-	c.peersPublicKey = peersPublicKey
-	c.publicKey = publickey
-	c.privateKey = privateKey
-	if c.privateKey == nil {
-		return nil, errors.New("Local private key must be specified")
-	} else if c.publicKey == nil {
-		return nil, errors.New("Local public key must be specifed")
-	}
+	return c, nil
+}
 
-	// Send public key (unencrypted)
-	c.outBox <- c.publicKey[:]
+// errClosed is the error fail() records when Close shuts the
+// connection down before any read or write error has occurred.
+var errClosed = errors.New("Connection closed!")
 
-	// Recieve peers public key
-	select {
-	case err := <-c.errors:
-		return nil, err
-	case msg := <-c.inBox:
-		if len(msg) != 32 {
-			return nil, errors.New("Recieved invalid public key")
-		} else if c.peersPublicKey == nil {
-			c.peersPublicKey = &[32]byte{}
-			copy(c.peersPublicKey[:], msg)
-		} else if !bytes.Equal(msg, c.peersPublicKey[:]) {
-			return nil, errors.New("Expected diffrent public key")
-		}
+// fail records err as the sticky cause of this connection's death, if
+// nothing has failed it yet, and closes done so every blocked
+// goroutine and caller wakes up. Safe to call more than once, and
+// concurrently with Close.
+func (c *BoxConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
 	}
+	c.mu.Unlock()
+	c.closeOnce.Do(func() { close(c.done) })
+}
 
-	// Compute shared secret
-	c.sharedSecret = &[32]byte{}
-	box.Precompute(c.sharedSecret, c.peersPublicKey, c.privateKey)
-	return c, nil
+// Err returns the error that stopped this connection: the first I/O
+// error a worker goroutine hit, or errClosed if Close was called
+// before any such error occurred. Returns nil while the connection is
+// still alive.
+func (c *BoxConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// HandshakeHash returns the Noise handshake hash, which both parties
+// agree on once the handshake completes. It can be used for channel
+// binding, e.g. mixed into an application-layer authentication token.
+func (c *BoxConn) HandshakeHash() []byte {
+	return c.handshakeHash
+}
+
+// PeersPublicKey returns the remote party's static public key, as
+// authenticated (Initiator) or revealed (Responder) by the handshake.
+func (c *BoxConn) PeersPublicKey() *[32]byte {
+	return c.peersPublicKey
 }
 
 // Set hold time (time to wait for additional write calls) [10 microsecs]
@@ -99,32 +250,59 @@ func (c *BoxConn) SetHoldtime(t time.Duration) {
 	c.holdTime = t
 }
 
+// SetRekeyInterval sets how many frames may be sealed (or unsealed) in
+// a given direction before that direction's key is rotated to a fresh
+// one derived from the current key. Must be called before the first
+// WriteFrame/ReadFrame and must match on both peers. A value of 0
+// disables rekeying. [1<<20 frames by default]
+func (c *BoxConn) SetRekeyInterval(frames uint64) {
+	c.rekeyInterval = frames
+}
+
 // Send a frame manually
 func (c *BoxConn) WriteFrame(frame []byte) error {
 	if len(frame) > MaxContent {
 		return errors.New("Frame too large!")
 	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
 	enc, err := c.seal(frame)
 	if err != nil {
 		return err
 	}
 	select {
-	case err := <-c.errors:
-		return err
 	case c.outBox <- enc:
+	case <-c.done:
+		putFrameBuffer(enc)
+		return c.Err()
 	}
 	return nil
 }
 
-// Read next frame
+// Read next frame. The returned buffer is pooled: release it with
+// ReleaseFrame once you're done with it.
 func (c *BoxConn) ReadFrame() ([]byte, error) {
 	select {
-	case err := <-c.errors:
-		return nil, err
+	case <-c.done:
+		return nil, c.Err()
 	case msg := <-c.inBox:
-		return c.unseal(msg)
+		plain, err := c.unseal(msg)
+		if err != nil {
+			putFrameBuffer(msg)
+			return nil, err
+		}
+		return plain, nil
 	}
-	return nil, nil
+}
+
+// ReleaseFrame returns a buffer previously obtained from ReadFrame to
+// the shared pool, so later ReadFrame/WriteFrame calls can reuse its
+// backing array instead of allocating a new one.
+func (c *BoxConn) ReleaseFrame(frame []byte) {
+	putFrameBuffer(frame)
 }
 
 // Read and return excactly n bytes from the stream
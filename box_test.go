@@ -0,0 +1,96 @@
+package boxtransport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func testKeypair(t *testing.T, seed byte) (priv, pub *[32]byte) {
+	t.Helper()
+	priv = &[32]byte{seed}
+	pub = &[32]byte{}
+	s, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("X25519: %v", err)
+	}
+	copy(pub[:], s)
+	return priv, pub
+}
+
+// TestRoundTrip runs a full Initiator/Responder handshake over
+// net.Pipe, exchanges data in both directions, and checks that Close
+// tears both ends down cleanly.
+func TestRoundTrip(t *testing.T) {
+	cPriv, cPub := testKeypair(t, 1)
+	sPriv, sPub := testKeypair(t, 2)
+	cConn, sConn := net.Pipe()
+
+	type res struct {
+		c   *BoxConn
+		err error
+	}
+	cch := make(chan res, 1)
+	sch := make(chan res, 1)
+	go func() {
+		c, err := Initiator(cConn, cPub, cPriv, sPub)
+		cch <- res{c, err}
+	}()
+	go func() {
+		c, err := Responder(sConn, sPub, sPriv, nil)
+		sch <- res{c, err}
+	}()
+	cr, sr := <-cch, <-sch
+	if cr.err != nil {
+		t.Fatalf("client handshake: %v", cr.err)
+	}
+	if sr.err != nil {
+		t.Fatalf("server handshake: %v", sr.err)
+	}
+	client, server := cr.c, sr.c
+
+	if !bytes.Equal(client.HandshakeHash(), server.HandshakeHash()) {
+		t.Fatal("handshake hashes do not match")
+	}
+	if *server.PeersPublicKey() != *cPub {
+		t.Fatal("server did not learn the client's static key")
+	}
+
+	clientMsg := []byte("hello from client")
+	serverMsg := []byte("hello from server")
+
+	if _, err := client.Write(clientMsg); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	got, err := server.ReadN(len(clientMsg))
+	if err != nil {
+		t.Fatalf("server read: %v", err)
+	}
+	if !bytes.Equal(got, clientMsg) {
+		t.Fatalf("server got %q, want %q", got, clientMsg)
+	}
+
+	if _, err := server.Write(serverMsg); err != nil {
+		t.Fatalf("server write: %v", err)
+	}
+	got, err = client.ReadN(len(serverMsg))
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if !bytes.Equal(got, serverMsg) {
+		t.Fatalf("client got %q, want %q", got, serverMsg)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("client close: %v", err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatalf("server close: %v", err)
+	}
+
+	if _, err := client.Write(clientMsg); err == nil {
+		t.Fatal("write after close should fail")
+	}
+}
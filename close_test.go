@@ -0,0 +1,57 @@
+package boxtransport
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestCloseIdempotent calls Close from many goroutines at once: Close
+// must be safe to call more than once (and concurrently with itself),
+// always waiting for the worker goroutines to exit, and every call
+// must return the same error.
+func TestCloseIdempotent(t *testing.T) {
+	client, server := benchmarkPair(&testing.B{})
+	defer server.Close()
+
+	const goroutines = 8
+	errs := make([]error, goroutines)
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = client.Close()
+		}(g)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Close() call %d: %v", i, err)
+		}
+	}
+}
+
+// TestCloseAfterPeerHangup is a regression test: Close used to surface
+// whatever error stopped the worker goroutines (e.g. an EOF recorded
+// by boxReader because the peer closed first) as its own return value,
+// making a deliberate, successful Close look like a failure just
+// because the peer had already hung up. Close must report only what
+// closing the local connection itself returned.
+func TestCloseAfterPeerHangup(t *testing.T) {
+	client, server := benchmarkPair(&testing.B{})
+	defer client.Close()
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("server close: %v", err)
+	}
+
+	// Give boxReader/boxWriter on the client side a chance to observe
+	// the peer hanging up (e.g. via EOF) before we close our own end.
+	buf := make([]byte, 1)
+	client.Read(buf)
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("client close after peer hangup: %v", err)
+	}
+}
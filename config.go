@@ -0,0 +1,108 @@
+package boxtransport
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+/*
+ This file provides a crypto/tls-style Config, plus Server/Client
+ wrappers around it, so callers can handshake a raw net.Conn without
+ wiring up Initiator/Responder by hand.
+*/
+
+// Config describes how to run a Noise IK handshake over a net.Conn,
+// mirroring how crypto/tls.Config and tailscale's control transport
+// are consumed.
+type Config struct {
+	// PrivateKey and PublicKey are this side's long-term Curve25519
+	// static keypair. Both are required.
+	PrivateKey *[32]byte
+	PublicKey  *[32]byte
+
+	// PeerPublicKey pins the expected remote static key. Required for
+	// Client/Dial, since the initiator always knows who it intends to
+	// talk to. Optional for Server/Listen: if nil, any initiator is
+	// accepted and VerifyPeer (if set) is consulted instead.
+	PeerPublicKey *[32]byte
+
+	// VerifyPeer, if set, is called with the remote static key once
+	// the handshake has authenticated it, and may reject the
+	// connection by returning a non-nil error. Useful for checking a
+	// peer against a dynamic allowlist instead of a single pinned key.
+	VerifyPeer func(peerPublicKey *[32]byte) error
+
+	// HoldTime is forwarded to BoxConn.SetHoldtime. Zero keeps
+	// BoxConn's own default.
+	HoldTime time.Duration
+
+	// MaxReadSize, if non-zero, caps how many bytes a single Read call
+	// will return. MaxWriteSize, if non-zero, rejects a single Write
+	// call that exceeds it rather than silently truncating it, since a
+	// net.Conn must not report a short write without an error.
+	MaxReadSize  int
+	MaxWriteSize int
+}
+
+// Client runs the Noise IK handshake over conn as the initiator,
+// authenticating the remote party against cfg.PeerPublicKey, and
+// returns conn wrapped as a net.Conn. It mirrors tls.Client.
+func Client(conn net.Conn, cfg *Config) (net.Conn, error) {
+	bc, err := Initiator(conn, cfg.PublicKey, cfg.PrivateKey, cfg.PeerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.apply(bc)
+}
+
+// Server runs the Noise IK handshake over conn as the responder and
+// returns conn wrapped as a net.Conn. It mirrors tls.Server.
+func Server(conn net.Conn, cfg *Config) (net.Conn, error) {
+	bc, err := Responder(conn, cfg.PublicKey, cfg.PrivateKey, cfg.PeerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.apply(bc)
+}
+
+// apply applies cfg's settings to a freshly handshaked bc, checking
+// VerifyPeer and wrapping bc to enforce the configured size limits if
+// either is set.
+func (cfg *Config) apply(bc *BoxConn) (net.Conn, error) {
+	if cfg.HoldTime > 0 {
+		bc.SetHoldtime(cfg.HoldTime)
+	}
+	if cfg.VerifyPeer != nil {
+		if err := cfg.VerifyPeer(bc.PeersPublicKey()); err != nil {
+			bc.Close()
+			return nil, err
+		}
+	}
+	if cfg.MaxReadSize > 0 || cfg.MaxWriteSize > 0 {
+		return &limitedConn{BoxConn: bc, maxRead: cfg.MaxReadSize, maxWrite: cfg.MaxWriteSize}, nil
+	}
+	return bc, nil
+}
+
+// limitedConn enforces Config.MaxReadSize/MaxWriteSize around a
+// handshaked BoxConn.
+type limitedConn struct {
+	*BoxConn
+	maxRead  int
+	maxWrite int
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if c.maxRead > 0 && len(b) > c.maxRead {
+		b = b[:c.maxRead]
+	}
+	return c.BoxConn.Read(b)
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if c.maxWrite > 0 && len(b) > c.maxWrite {
+		return 0, errors.New("Write exceeds configured size limit")
+	}
+	return c.BoxConn.Write(b)
+}
@@ -11,12 +11,29 @@ import (
 
 // Write bytes to stream
 func (c *BoxConn) Write(b []byte) (n int, err error) {
-	cnt := make(chan int)
-	c.outStream <- &writeRequest{msg: b, n: cnt}
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+	req := getWriteRequest()
+	req.msg = b
+	select {
+	case c.outStream <- req:
+	case <-c.done:
+		// streamWriter never saw req, so it's still ours to recycle.
+		putWriteRequest(req)
+		return 0, c.Err()
+	}
+	// From here req belongs to streamWriter. If we give up on it below
+	// via done, streamWriter (not us) owns it: it returns it to the pool
+	// once it has copied all of req.msg, or drops it unpooled if it
+	// gives up via done first; pooling it here too would
+	// let a new Write reuse the same *writeRequest while streamWriter
+	// is still mutating it.
 	for n < len(b) {
 		select {
-		case err = <-c.errors:
-		case m := <-cnt:
+		case <-c.done:
+			return n, c.Err()
+		case m := <-req.n:
 			n += m
 		}
 	}
@@ -33,24 +50,22 @@ func (c *BoxConn) Read(b []byte) (int, error) {
 		return 0, err
 	}
 	c.plain.Write(msg)
+	c.ReleaseFrame(msg)
 	return c.plain.Read(b)
 }
 
-// Close BoxConn
+// Close BoxConn. Safe to call more than once, and concurrently with
+// Read/Write: it always waits for boxReader, boxWriter and
+// streamWriter to exit before returning, so none of them touch the
+// connection after Close returns. It reports whatever the underlying
+// conn.Close() returned, not whatever caused the worker goroutines to
+// stop (use Err() for that) — otherwise a peer hanging up first would
+// make a deliberate, successful Close look like a failure.
 func (c *BoxConn) Close() error {
+	c.fail(errClosed)
 	err := c.conn.Close()
-	if err != nil {
-		return err
-	}
-	close(c.inBox)
-	close(c.outBox)
-	close(c.outStream)
-	select {
-	case err := <-c.errors:
-		return err
-	default:
-	}
-	return nil
+	c.wg.Wait()
+	return err
 }
 
 // Passthough to lower level
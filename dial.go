@@ -0,0 +1,125 @@
+package boxtransport
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ This file provides Listen/Dial helpers so boxtransport can be used as
+ a drop-in replacement for net.Listen/net.Dial in existing servers.
+*/
+
+// Listen listens on the given network and address and returns a
+// net.Listener whose Accept returns immediately, deferring the Noise
+// IK handshake to each connection's first Read or Write, mirroring
+// crypto/tls.Listen. Otherwise a single slow or hostile client that
+// never completes the handshake would block Accept for every other
+// pending connection.
+func Listen(network, addr string, cfg *Config) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: ln, cfg: cfg}, nil
+}
+
+type listener struct {
+	net.Listener
+	cfg *Config
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &serverConn{raw: conn, cfg: l.cfg}, nil
+}
+
+// serverConn wraps a raw, not-yet-handshaked net.Conn accepted by
+// listener, running the Noise IK handshake lazily on the first Read,
+// Write, or explicit Handshake call, exactly once, mirroring
+// tls.Conn's lazy handshake.
+type serverConn struct {
+	raw net.Conn
+	cfg *Config
+
+	once sync.Once
+	mu   sync.Mutex
+	conn net.Conn
+	err  error
+}
+
+// Handshake runs the Noise IK handshake if it hasn't already started,
+// and returns its result. Safe to call more than once and
+// concurrently with Read/Write, which call it themselves.
+func (c *serverConn) Handshake() error {
+	c.once.Do(func() {
+		conn, err := Server(c.raw, c.cfg)
+		c.mu.Lock()
+		c.conn, c.err = conn, err
+		c.mu.Unlock()
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.Read(b)
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.Write(b)
+}
+
+// Close closes the underlying connection without forcing a handshake
+// to run first: a peer that never starts (or never finishes) the
+// handshake must still be closeable without blocking on, or even
+// triggering, one.
+func (c *serverConn) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn.Close()
+	}
+	return c.raw.Close()
+}
+
+func (c *serverConn) LocalAddr() net.Addr  { return c.raw.LocalAddr() }
+func (c *serverConn) RemoteAddr() net.Addr { return c.raw.RemoteAddr() }
+
+func (c *serverConn) SetDeadline(t time.Time) error      { return c.raw.SetDeadline(t) }
+func (c *serverConn) SetReadDeadline(t time.Time) error  { return c.raw.SetReadDeadline(t) }
+func (c *serverConn) SetWriteDeadline(t time.Time) error { return c.raw.SetWriteDeadline(t) }
+
+// Dial connects to addr over network and runs the Noise IK handshake
+// as the initiator against cfg, authenticating the remote party
+// against cfg.PeerPublicKey.
+func Dial(network, addr string, cfg *Config) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := Client(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return bc, nil
+}
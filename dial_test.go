@@ -0,0 +1,131 @@
+package boxtransport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestListenDialRoundTrip dials a listener started with Listen and
+// checks that a normal client can complete the handshake and exchange
+// data in both directions.
+func TestListenDialRoundTrip(t *testing.T) {
+	sPriv, sPub := testKeypair(t, 1)
+	cPriv, cPub := testKeypair(t, 2)
+
+	ln, err := Listen("tcp", "127.0.0.1:0", &Config{
+		PrivateKey: sPriv,
+		PublicKey:  sPub,
+	})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	acceptErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptErr <- err
+			return
+		}
+		// Accept itself doesn't handshake; run it explicitly here,
+		// concurrently with the client's Dial below, the way a real
+		// server handler would by reading from conn right away.
+		if hs, ok := conn.(interface{ Handshake() error }); ok {
+			if err := hs.Handshake(); err != nil {
+				acceptErr <- err
+				return
+			}
+		}
+		accepted <- conn
+	}()
+
+	client, err := Dial("tcp", ln.Addr().String(), &Config{
+		PrivateKey:    cPriv,
+		PublicKey:     cPub,
+		PeerPublicKey: sPub,
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case err := <-acceptErr:
+		t.Fatalf("Accept: %v", err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Accept never returned")
+	}
+	defer server.Close()
+
+	msg := []byte("hello over Listen/Dial")
+	if _, err := client.Write(msg); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := readFull(server, got); err != nil {
+		t.Fatalf("server read: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("server got %q, want %q", got, msg)
+	}
+}
+
+// TestAcceptDoesNotBlockOnHandshake is a regression test: Accept used
+// to run the Noise IK handshake synchronously, so a client that opens
+// the TCP connection and never speaks blocks Accept for every other
+// pending connection on the listener. Accept must now return
+// immediately, deferring the handshake to the returned conn's first
+// Read/Write.
+func TestAcceptDoesNotBlockOnHandshake(t *testing.T) {
+	sPriv, sPub := testKeypair(t, 3)
+
+	ln, err := Listen("tcp", "127.0.0.1:0", &Config{
+		PrivateKey: sPriv,
+		PublicKey:  sPub,
+	})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	// A client that never speaks: opens the connection and does
+	// nothing, standing in for a slow or hostile peer.
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer silent.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Accept blocked on the silent client's handshake")
+	}
+}
+
+func readFull(conn net.Conn, b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := conn.Read(b[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
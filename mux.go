@@ -0,0 +1,339 @@
+package boxtransport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+ This file implements channel multiplexing on top of BoxConn.
+
+ BoxMuxConn lets callers open several independent logical streams
+ (channels) over a single encrypted connection. Every channel is
+ identified by a 1-byte ID which is prepended to the plaintext before
+ it is sealed, so a single BoxConn frame always carries exactly one
+ channel's data. A writer goroutine schedules pending channels using a
+ weighted round-robin so that a single misbehaving (non-draining or
+ bursty) channel cannot starve the others.
+*/
+
+// ChannelDescriptor configures a single multiplexed channel, mirroring
+// the ChannelDescriptor pattern used by Tendermint/Bytom's p2p layer.
+type ChannelDescriptor struct {
+	ID                 byte
+	Priority           int
+	SendQueueCapacity  int
+	RecvBufferCapacity int
+}
+
+// BoxMuxConn multiplexes several MuxChannels over a single BoxConn.
+type BoxMuxConn struct {
+	conn  *BoxConn
+	order []byte
+	chans map[byte]*MuxChannel
+
+	ready chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	closeOnce sync.Once
+	mu        sync.Mutex
+	err       error
+}
+
+// MuxChannel is a single logical stream multiplexed over a BoxMuxConn.
+// It exposes Read/Write/Close similar to net.Conn.
+type MuxChannel struct {
+	id       byte
+	priority int
+	parent   *BoxMuxConn
+
+	sendQueue chan []byte
+
+	recvMu   sync.Mutex
+	recvCond *sync.Cond
+	recv     bytes.Buffer
+	recvCap  int
+	err      error
+	closed   bool
+	closedCh chan struct{}
+}
+
+// NewBoxMuxConn wraps conn, creating one MuxChannel per descriptor.
+func NewBoxMuxConn(conn *BoxConn, descriptors []ChannelDescriptor) (*BoxMuxConn, error) {
+	m := &BoxMuxConn{
+		conn:  conn,
+		chans: make(map[byte]*MuxChannel, len(descriptors)),
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	for _, d := range descriptors {
+		if _, exists := m.chans[d.ID]; exists {
+			return nil, errors.New("Duplicate channel ID")
+		}
+		priority := d.Priority
+		if priority <= 0 {
+			// A zero Priority is Go's zero value for ChannelDescriptor
+			// and easy to hit by simply forgetting to set it. Treating
+			// it literally would let pickChannel's running weight for
+			// this channel never grow, so it would lose to any channel
+			// with a positive priority and a steady backlog forever,
+			// which is exactly the starvation the weighted round-robin
+			// scheduler is there to prevent.
+			priority = 1
+		}
+		ch := &MuxChannel{
+			id:        d.ID,
+			priority:  priority,
+			parent:    m,
+			sendQueue: make(chan []byte, d.SendQueueCapacity),
+			recvCap:   d.RecvBufferCapacity,
+			closedCh:  make(chan struct{}),
+		}
+		ch.recvCond = sync.NewCond(&ch.recvMu)
+		m.chans[d.ID] = ch
+		m.order = append(m.order, d.ID)
+	}
+
+	m.wg.Add(2)
+	go m.writeLoop()
+	go m.readLoop()
+	return m, nil
+}
+
+// Channel returns the MuxChannel registered for id, or an error if no
+// such channel was declared when the BoxMuxConn was created.
+func (m *BoxMuxConn) Channel(id byte) (*MuxChannel, error) {
+	m.mu.Lock()
+	ch, ok := m.chans[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, errors.New("No such channel")
+	}
+	return ch, nil
+}
+
+// Close shuts down every channel and the underlying BoxConn.
+func (m *BoxMuxConn) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	err := m.conn.Close()
+	m.wg.Wait()
+	for _, id := range m.order {
+		m.chans[id].Close()
+	}
+	return err
+}
+
+// fail records the first error seen, closes done so every channel
+// waiting on a Write unblocks the same way Close makes it unblock, and
+// unblocks every channel waiting on a Read.
+func (m *BoxMuxConn) fail(err error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	m.mu.Unlock()
+	m.closeOnce.Do(func() { close(m.done) })
+	for _, id := range m.order {
+		ch := m.chans[id]
+		ch.recvMu.Lock()
+		if ch.err == nil {
+			ch.err = err
+		}
+		ch.recvCond.Broadcast()
+		ch.recvMu.Unlock()
+	}
+}
+
+// signal wakes up writeLoop so it re-evaluates the scheduler.
+func (m *BoxMuxConn) signal() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop picks the next frame to seal using a weighted round-robin
+// over channels that currently have data queued, then hands it to the
+// underlying BoxConn for sealing and sending.
+func (m *BoxMuxConn) writeLoop() {
+	defer m.wg.Done()
+	current := make(map[byte]int, len(m.order))
+	totalWeight := 0
+	for _, id := range m.order {
+		totalWeight += m.chans[id].priority
+	}
+	for {
+		id, ok := m.pickChannel(current, totalWeight)
+		if !ok {
+			select {
+			case <-m.ready:
+				continue
+			case <-m.done:
+				return
+			}
+		}
+		ch := m.chans[id]
+		select {
+		case payload := <-ch.sendQueue:
+			frame := make([]byte, 1+len(payload))
+			frame[0] = id
+			copy(frame[1:], payload)
+			if err := m.conn.WriteFrame(frame); err != nil {
+				m.fail(err)
+				return
+			}
+		case <-m.done:
+			return
+		default:
+			// Queue emptied between the pick and the receive; retry.
+		}
+	}
+}
+
+// pickChannel implements a smooth weighted round-robin: each eligible
+// (non-empty) channel's running weight is bumped by its Priority, the
+// highest one is chosen, and its running weight is discounted by the
+// total priority of all channels so lower priority channels still get
+// a turn.
+func (m *BoxMuxConn) pickChannel(current map[byte]int, totalWeight int) (byte, bool) {
+	var best byte
+	bestWeight := -(1 << 62)
+	found := false
+	for _, id := range m.order {
+		ch := m.chans[id]
+		if len(ch.sendQueue) == 0 {
+			continue
+		}
+		current[id] += ch.priority
+		if current[id] > bestWeight {
+			bestWeight = current[id]
+			best = id
+			found = true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	current[best] -= totalWeight
+	return best, true
+}
+
+// readLoop reads sealed frames from the BoxConn, strips the channel ID
+// byte and routes the remaining plaintext into the right channel.
+func (m *BoxMuxConn) readLoop() {
+	defer m.wg.Done()
+	for {
+		frame, err := m.conn.ReadFrame()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		if len(frame) >= 1 {
+			id, payload := frame[0], frame[1:]
+			m.mu.Lock()
+			ch, ok := m.chans[id]
+			m.mu.Unlock()
+			if ok {
+				ch.deliver(payload)
+			}
+		}
+		// deliver copies payload into the channel's own buffer, so
+		// frame can always be released here regardless of which branch
+		// above ran; otherwise every frame routed through a BoxMuxConn
+		// leaks its pooled buffer out of framePool for good.
+		m.conn.ReleaseFrame(frame)
+	}
+}
+
+// errRecvOverflow is the error deliver records on a channel whose
+// receiver didn't drain it fast enough.
+var errRecvOverflow = errors.New("Channel receive buffer exceeded RecvBufferCapacity")
+
+// deliver appends payload to the channel's receive buffer. If the
+// receiver isn't draining fast enough to stay under RecvBufferCapacity,
+// the channel fails with errRecvOverflow instead of silently dropping
+// data, so a stalled reader sees an explicit error rather than a
+// silently truncated stream; this still can't block readLoop or starve
+// the other channels, since failing the channel here doesn't block.
+func (ch *MuxChannel) deliver(payload []byte) {
+	ch.recvMu.Lock()
+	defer ch.recvMu.Unlock()
+	if ch.err != nil || (ch.recvCap > 0 && ch.recv.Len()+len(payload) > ch.recvCap) {
+		if ch.err == nil {
+			ch.err = errRecvOverflow
+		}
+		ch.recvCond.Broadcast()
+		return
+	}
+	ch.recv.Write(payload)
+	ch.recvCond.Broadcast()
+}
+
+// maxChannelPayload is the most a single queued chunk may carry: a
+// frame is the 1-byte channel ID plus the chunk, and the whole frame
+// must fit within BoxConn's MaxContent.
+const maxChannelPayload = MaxContent - 1
+
+// Write queues b for sending on this channel, splitting it into
+// chunks of at most maxChannelPayload bytes so a single large Write
+// can never produce a frame too big for the underlying BoxConn to
+// send (which would fail the whole BoxMuxConn, not just this
+// channel). It returns once every chunk has been handed to the
+// scheduler, not once it has actually been sent.
+func (ch *MuxChannel) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChannelPayload {
+			chunk = chunk[:maxChannelPayload]
+		}
+		cp := make([]byte, len(chunk))
+		copy(cp, chunk)
+		select {
+		case ch.sendQueue <- cp:
+			ch.parent.signal()
+		case <-ch.closedCh:
+			return n, errors.New("Channel closed")
+		case <-ch.parent.done:
+			return n, errors.New("Connection closed")
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Read blocks until data is available on this channel, the channel is
+// closed, or the underlying connection fails.
+func (ch *MuxChannel) Read(b []byte) (int, error) {
+	ch.recvMu.Lock()
+	defer ch.recvMu.Unlock()
+	for ch.recv.Len() == 0 && ch.err == nil && !ch.closed {
+		ch.recvCond.Wait()
+	}
+	if ch.recv.Len() > 0 {
+		return ch.recv.Read(b)
+	}
+	if ch.err != nil {
+		return 0, ch.err
+	}
+	return 0, io.EOF
+}
+
+// Close marks the channel closed, unblocking any pending Read or Write.
+// It does not close the underlying BoxMuxConn.
+func (ch *MuxChannel) Close() error {
+	ch.recvMu.Lock()
+	if !ch.closed {
+		ch.closed = true
+		close(ch.closedCh)
+		ch.recvCond.Broadcast()
+	}
+	ch.recvMu.Unlock()
+	return nil
+}
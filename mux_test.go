@@ -0,0 +1,239 @@
+package boxtransport
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestMuxPriorityNoStarvation is a regression test for a zero-Priority
+// channel (Go's zero value for ChannelDescriptor, easy to hit by
+// simply forgetting to set it) being permanently starved once another
+// channel keeps a steady backlog: pickChannel's running weight for a
+// zero-priority channel never grows, so it never wins against any
+// channel with positive priority. NewBoxMuxConn clamps Priority <= 0
+// to 1 to prevent that.
+func TestMuxPriorityNoStarvation(t *testing.T) {
+	client, server := benchmarkPair(&testing.B{})
+	defer client.Close()
+	defer server.Close()
+
+	m, err := NewBoxMuxConn(client, []ChannelDescriptor{
+		{ID: 1, Priority: 0, SendQueueCapacity: 64, RecvBufferCapacity: 1 << 16},
+		{ID: 2, Priority: 5, SendQueueCapacity: 64, RecvBufferCapacity: 1 << 16},
+	})
+	if err != nil {
+		t.Fatalf("NewBoxMuxConn: %v", err)
+	}
+	defer m.Close()
+
+	ch1, err := m.Channel(1)
+	if err != nil {
+		t.Fatalf("Channel(1): %v", err)
+	}
+	ch2, err := m.Channel(2)
+	if err != nil {
+		t.Fatalf("Channel(2): %v", err)
+	}
+
+	// Keep channel 2 continuously backlogged, the condition under
+	// which a zero-priority channel 1 used to starve. Fill its send
+	// queue before ch1 ever gets a turn, so there is real contention
+	// from the very first scheduling decision onward.
+	stop := make(chan struct{})
+	defer close(stop)
+	started := make(chan struct{})
+	go func() {
+		payload := []byte("busy")
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			ch2.Write(payload)
+			if i == 32 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+
+	// Drain raw frames from the wire and report which channel each one
+	// belongs to; we don't need a receiving BoxMuxConn for this test.
+	seen := make(chan byte, 256)
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if len(frame) >= 1 {
+				seen <- frame[0]
+			}
+			server.ReleaseFrame(frame)
+		}
+	}()
+
+	if _, err := ch1.Write([]byte("hi")); err != nil {
+		t.Fatalf("ch1 write: %v", err)
+	}
+
+	deadline := time.After(3 * time.Second)
+	for {
+		select {
+		case id := <-seen:
+			if id == 1 {
+				return
+			}
+		case <-deadline:
+			t.Fatal("priority-0 channel was starved for 3s against a backlogged peer")
+		}
+	}
+}
+
+// TestMuxWriteUnblocksOnFailure is a regression test: fail previously
+// only recorded m.err and unblocked pending Reads, never closing
+// m.done, so a MuxChannel.Write blocked on a full SendQueueCapacity
+// had nothing to wake it once writeLoop died (peer hangup, a
+// WriteFrame error, anything) — a silent, permanent deadlock. fail now
+// closes m.done too, so Write unblocks with an error the same way Read
+// does.
+func TestMuxWriteUnblocksOnFailure(t *testing.T) {
+	client, server := benchmarkPair(&testing.B{})
+	defer client.Close()
+
+	m, err := NewBoxMuxConn(client, []ChannelDescriptor{
+		{ID: 1, Priority: 1, SendQueueCapacity: 1, RecvBufferCapacity: 1 << 16},
+	})
+	if err != nil {
+		t.Fatalf("NewBoxMuxConn: %v", err)
+	}
+	defer m.Close()
+
+	ch, err := m.Channel(1)
+	if err != nil {
+		t.Fatalf("Channel(1): %v", err)
+	}
+
+	// Kill the connection from the far end: the next frame writeLoop
+	// attempts to send will fail, calling fail and killing writeLoop.
+	// Nobody is draining ch.sendQueue after that, so a Write that
+	// fills it and then blocks on the next one has nothing to wake it
+	// except fail closing m.done.
+	server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if _, err := ch.Write([]byte("x")); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("writes never failed after the connection died")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write did not unblock after the connection failed")
+	}
+}
+
+// TestMuxWriteFragmentsLargePayload is a regression test: MuxChannel
+// used to hand a Write's entire payload to writeLoop as a single
+// frame with no size check. A payload large enough to push the frame
+// (1 id byte + payload) over BoxConn's MaxContent made WriteFrame
+// reject it, so writeLoop called fail and died, killing every channel
+// on the BoxMuxConn over one channel's legitimately large write.
+// Write now chunks large payloads the way BoxConn.Write/streamWriter
+// already do, so a large write round-trips correctly instead of
+// taking down the connection.
+func TestMuxWriteFragmentsLargePayload(t *testing.T) {
+	client, server := benchmarkPair(&testing.B{})
+	defer client.Close()
+	defer server.Close()
+
+	descriptors := []ChannelDescriptor{
+		{ID: 1, Priority: 1, SendQueueCapacity: 8, RecvBufferCapacity: 1 << 20},
+	}
+	cm, err := NewBoxMuxConn(client, descriptors)
+	if err != nil {
+		t.Fatalf("client NewBoxMuxConn: %v", err)
+	}
+	defer cm.Close()
+	sm, err := NewBoxMuxConn(server, descriptors)
+	if err != nil {
+		t.Fatalf("server NewBoxMuxConn: %v", err)
+	}
+	defer sm.Close()
+
+	cch, err := cm.Channel(1)
+	if err != nil {
+		t.Fatalf("client Channel(1): %v", err)
+	}
+	sch, err := sm.Channel(1)
+	if err != nil {
+		t.Fatalf("server Channel(1): %v", err)
+	}
+
+	payload := make([]byte, MaxContent*3+17)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := cch.Write(payload)
+		writeErr <- err
+	}()
+
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(sch, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("round-tripped payload does not match what was written")
+	}
+}
+
+// TestMuxRecvOverflowFailsChannel is a regression test: deliver used
+// to silently drop payloads once RecvBufferCapacity was exceeded, with
+// no error and no signal, corrupting the stream with an undetectable
+// gap. deliver now fails the channel with errRecvOverflow instead, so
+// a slow reader sees an explicit error rather than silently truncated
+// data.
+func TestMuxRecvOverflowFailsChannel(t *testing.T) {
+	client, server := benchmarkPair(&testing.B{})
+	defer client.Close()
+	defer server.Close()
+
+	m, err := NewBoxMuxConn(client, []ChannelDescriptor{
+		{ID: 1, Priority: 1, SendQueueCapacity: 1, RecvBufferCapacity: 4},
+	})
+	if err != nil {
+		t.Fatalf("NewBoxMuxConn: %v", err)
+	}
+	defer m.Close()
+
+	ch, err := m.Channel(1)
+	if err != nil {
+		t.Fatalf("Channel(1): %v", err)
+	}
+
+	ch.deliver([]byte("12345678"))
+
+	buf := make([]byte, 8)
+	_, err = ch.Read(buf)
+	if err != errRecvOverflow {
+		t.Fatalf("Read error = %v, want %v", err, errRecvOverflow)
+	}
+}
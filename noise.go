@@ -0,0 +1,396 @@
+package boxtransport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+/*
+ This file implements a Noise_IK_25519_ChaChaPoly_BLAKE2s handshake,
+ in the style of Tailscale's controlbase: no generic Noise framework,
+ just the IK pattern hand-rolled against the primitives we need. It
+ gives the initiator identity hiding (the initiator's static key only
+ ever travels encrypted under an ephemeral-static DH), authenticates
+ the responder against a known public key, and provides forward
+ secrecy via freshly generated ephemeral keys on every handshake.
+*/
+
+const (
+	noiseProtocolName = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+	noiseHashSize     = blake2s.Size
+	noiseVersion      = uint16(1)
+)
+
+// noiseKey is a Curve25519 scalar or point.
+type noiseKey [32]byte
+
+// cipherState is the Noise CipherState object: an AEAD key plus a
+// strictly increasing nonce. Before the first mixKey call it has no
+// key, in which case encrypt/decrypt are no-ops (used while the static
+// key of one party is still unknown to the other).
+type cipherState struct {
+	key   noiseKey
+	nonce uint64
+	set   bool
+}
+
+func (cs *cipherState) encryptWithAd(out, ad, plaintext []byte) ([]byte, error) {
+	if !cs.set {
+		return append(out, plaintext...), nil
+	}
+	aead, err := chacha20poly1305.New(cs.key[:])
+	if err != nil {
+		return nil, err
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+	return aead.Seal(out, nonce[:], plaintext, ad), nil
+}
+
+func (cs *cipherState) decryptWithAd(out, ad, ciphertext []byte) ([]byte, error) {
+	if !cs.set {
+		return append(out, ciphertext...), nil
+	}
+	aead, err := chacha20poly1305.New(cs.key[:])
+	if err != nil {
+		return nil, err
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+	return aead.Open(out, nonce[:], ciphertext, ad)
+}
+
+// symmetricState is the Noise SymmetricState object.
+type symmetricState struct {
+	cs cipherState
+	ck [noiseHashSize]byte
+	h  [noiseHashSize]byte
+}
+
+func newSymmetricState() *symmetricState {
+	ss := &symmetricState{}
+	if len(noiseProtocolName) <= noiseHashSize {
+		copy(ss.h[:], noiseProtocolName)
+	} else {
+		ss.h = blake2s.Sum256([]byte(noiseProtocolName))
+	}
+	ss.ck = ss.h
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h, _ := blake2s.New256(nil)
+	h.Write(ss.h[:])
+	h.Write(data)
+	copy(ss.h[:], h.Sum(nil))
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	k1, k2 := noiseHKDF2(ss.ck[:], ikm)
+	ss.ck = k1
+	ss.cs = cipherState{key: k2, set: true}
+}
+
+func (ss *symmetricState) encryptAndHash(out, plaintext []byte) ([]byte, error) {
+	res, err := ss.cs.encryptWithAd(out, ss.h[:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(res[len(out):])
+	return res, nil
+}
+
+func (ss *symmetricState) decryptAndHash(out, ciphertext []byte) ([]byte, error) {
+	res, err := ss.cs.decryptWithAd(out, ss.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return res, nil
+}
+
+// split derives the two directional transport keys once the handshake
+// completes. By convention the initiator's send key is the responder's
+// receive key, and vice versa.
+func (ss *symmetricState) split() (k1, k2 noiseKey) {
+	return noiseHKDF2(ss.ck[:], nil)
+}
+
+func noiseHMAC(key, data []byte) [noiseHashSize]byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	mac.Write(data)
+	var out [noiseHashSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+func noiseHKDF2(chainKey, ikm []byte) (k1, k2 [noiseHashSize]byte) {
+	tempKey := noiseHMAC(chainKey, ikm)
+	k1 = noiseHMAC(tempKey[:], []byte{0x01})
+	k2 = noiseHMAC(tempKey[:], append(append([]byte{}, k1[:]...), 0x02))
+	return
+}
+
+func noiseDH(priv, pub *[32]byte) (out [32]byte, err error) {
+	shared, err := curve25519.X25519(priv[:], pub[:])
+	if err != nil {
+		return out, err
+	}
+	copy(out[:], shared)
+	return out, nil
+}
+
+// noiseHandshake carries the state needed to run one side of the IK
+// pattern:
+//
+//	-> e, es, s, ss
+//	<- e, ee, se
+type noiseHandshake struct {
+	ss *symmetricState
+
+	initiator bool
+	s, spub   *[32]byte // local static keypair
+	e, epub   *[32]byte // local ephemeral keypair (generated per handshake)
+	rs        *[32]byte // remote static public key
+	re        *[32]byte // remote ephemeral public key
+
+	// expectedInitiator optionally pins the initiator's static key, as
+	// seen by the responder (nil accepts whatever key is revealed).
+	expectedInitiator *[32]byte
+}
+
+// newNoiseHandshake starts one side of the IK pattern. For the
+// initiator, rs pins the known responder static key (required). For
+// the responder, rs optionally pins the expected initiator static key
+// (checked once it is revealed in message 1); it is unrelated to the
+// pre-message below.
+func newNoiseHandshake(initiator bool, s, spub, rs *[32]byte) (*noiseHandshake, error) {
+	if initiator && rs == nil {
+		return nil, errors.New("Initiator must know the responder's public key")
+	}
+	hs := &noiseHandshake{
+		ss:        newSymmetricState(),
+		initiator: initiator,
+		s:         s,
+		spub:      spub,
+	}
+	// Pre-message: the responder's static key is known in advance by
+	// both parties (token "<- s"). The initiator mixes in the known
+	// remote key; the responder mixes in its own public key, so both
+	// sides end up with an identical transcript hash.
+	if initiator {
+		hs.rs = rs
+		hs.ss.mixHash(rs[:])
+	} else {
+		hs.ss.mixHash(spub[:])
+		// rs pins the expected initiator key once it is revealed in
+		// message 1; keep it separate from the pre-message above.
+		hs.expectedInitiator = rs
+	}
+	return hs, nil
+}
+
+func generateEphemeral() (priv, pub *[32]byte, err error) {
+	priv, pub = &[32]byte{}, &[32]byte{}
+	if _, err = rand.Read(priv[:]); err != nil {
+		return nil, nil, err
+	}
+	scalar, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(pub[:], scalar)
+	return priv, pub, nil
+}
+
+// writeMessage1 is sent by the initiator: e, es, s, ss.
+func (hs *noiseHandshake) writeMessage1() ([]byte, error) {
+	if !hs.initiator || hs.rs == nil {
+		return nil, errors.New("Invalid handshake state for message 1")
+	}
+	e, epub, err := generateEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	hs.e, hs.epub = e, epub
+	hs.ss.mixHash(epub[:])
+
+	es, err := noiseDH(hs.e, hs.rs)
+	if err != nil {
+		return nil, err
+	}
+	hs.ss.mixKey(es[:])
+
+	out := append([]byte{}, epub[:]...)
+	out, err = hs.ss.encryptAndHash(out, hs.spub[:])
+	if err != nil {
+		return nil, err
+	}
+
+	ss, err := noiseDH(hs.s, hs.rs)
+	if err != nil {
+		return nil, err
+	}
+	hs.ss.mixKey(ss[:])
+	return out, nil
+}
+
+// readMessage1 is processed by the responder.
+func (hs *noiseHandshake) readMessage1(msg []byte) error {
+	if hs.initiator {
+		return errors.New("Invalid handshake state for message 1")
+	}
+	if len(msg) < 32 {
+		return errors.New("Handshake message 1 too short")
+	}
+	hs.re = &[32]byte{}
+	copy(hs.re[:], msg[:32])
+	hs.ss.mixHash(hs.re[:])
+
+	es, err := noiseDH(hs.s, hs.re)
+	if err != nil {
+		return err
+	}
+	hs.ss.mixKey(es[:])
+
+	spub, err := hs.ss.decryptAndHash(nil, msg[32:])
+	if err != nil {
+		return errors.New("Failed to decrypt initiator static key")
+	}
+	if len(spub) != 32 {
+		return errors.New("Invalid initiator static key")
+	}
+	hs.rs = &[32]byte{}
+	copy(hs.rs[:], spub)
+	if hs.expectedInitiator != nil && *hs.expectedInitiator != *hs.rs {
+		return errors.New("Expected diffrent public key")
+	}
+
+	ss, err := noiseDH(hs.s, hs.rs)
+	if err != nil {
+		return err
+	}
+	hs.ss.mixKey(ss[:])
+	return nil
+}
+
+// writeMessage2 is sent by the responder: e, ee, se.
+func (hs *noiseHandshake) writeMessage2() ([]byte, error) {
+	if hs.initiator || hs.rs == nil || hs.re == nil {
+		return nil, errors.New("Invalid handshake state for message 2")
+	}
+	e, epub, err := generateEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	hs.e, hs.epub = e, epub
+	hs.ss.mixHash(epub[:])
+
+	ee, err := noiseDH(hs.e, hs.re)
+	if err != nil {
+		return nil, err
+	}
+	hs.ss.mixKey(ee[:])
+
+	se, err := noiseDH(hs.e, hs.rs)
+	if err != nil {
+		return nil, err
+	}
+	hs.ss.mixKey(se[:])
+
+	out, err := hs.ss.encryptAndHash(append([]byte{}, epub[:]...), nil)
+	return out, err
+}
+
+// readMessage2 is processed by the initiator.
+func (hs *noiseHandshake) readMessage2(msg []byte) error {
+	if !hs.initiator {
+		return errors.New("Invalid handshake state for message 2")
+	}
+	if len(msg) < 32 {
+		return errors.New("Handshake message 2 too short")
+	}
+	hs.re = &[32]byte{}
+	copy(hs.re[:], msg[:32])
+	hs.ss.mixHash(hs.re[:])
+
+	ee, err := noiseDH(hs.e, hs.re)
+	if err != nil {
+		return err
+	}
+	hs.ss.mixKey(ee[:])
+
+	se, err := noiseDH(hs.s, hs.re)
+	if err != nil {
+		return err
+	}
+	hs.ss.mixKey(se[:])
+
+	if _, err := hs.ss.decryptAndHash(nil, msg[32:]); err != nil {
+		return errors.New("Failed to verify handshake message 2")
+	}
+	return nil
+}
+
+// split finishes the handshake, returning the directional transport
+// keys (tx, rx) from this party's point of view and the handshake
+// hash that both parties will agree on (usable for channel binding).
+func (hs *noiseHandshake) split() (tx, rx noiseKey, handshakeHash []byte) {
+	k1, k2 := hs.ss.split()
+	handshakeHash = append([]byte{}, hs.ss.h[:]...)
+	if hs.initiator {
+		return k1, k2, handshakeHash
+	}
+	return k2, k1, handshakeHash
+}
+
+// rekeyBlake2s derives a fresh transport key from the current one so
+// a long-lived BoxConn isn't stuck encrypting under a single key
+// forever, without needing a new handshake round-trip.
+func rekeyBlake2s(key noiseKey) noiseKey {
+	h, _ := blake2s.New256(key[:])
+	h.Write([]byte("boxtransport-rekey"))
+	var out noiseKey
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// writeHandshakeMessage sends msg on conn prefixed by its 2-byte
+// length, so the responder/initiator can frame handshake messages
+// before any BoxConn goroutines are running.
+func writeHandshakeMessage(conn net.Conn, msg []byte) error {
+	var lenBuf [LenFieldSize]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(msg)))
+	if _, err := conn.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// readHandshakeMessage reads one length-prefixed handshake message.
+func readHandshakeMessage(conn net.Conn) ([]byte, error) {
+	var lenBuf [LenFieldSize]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,49 @@
+package boxtransport
+
+import "sync"
+
+/*
+ This file pools the buffers and channels reused on every frame, so
+ steady-state streaming through BoxConn reuses frame buffers and
+ write-request channels in its hot paths (boxReader, streamWriter,
+ seal/unseal, Write) instead of allocating new ones. Other small
+ per-frame allocations remain (seal/unseal build a new AEAD each call).
+*/
+
+// framePool holds frame-sized []byte buffers, capacity MaxRawData so
+// they fit the largest frame boxReader or seal ever produces.
+var framePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, MaxRawData)
+		return &b
+	},
+}
+
+// getFrameBuffer returns an empty (len 0) buffer from the pool.
+func getFrameBuffer() []byte {
+	b := *(framePool.Get().(*[]byte))
+	return b[:0]
+}
+
+// putFrameBuffer returns a frame buffer to the pool for reuse.
+func putFrameBuffer(b []byte) {
+	b = b[:cap(b)]
+	framePool.Put(&b)
+}
+
+// writeRequestPool holds writeRequests, each with its own reusable
+// count channel, so Write doesn't allocate a fresh channel per call.
+var writeRequestPool = sync.Pool{
+	New: func() interface{} {
+		return &writeRequest{n: make(chan int)}
+	},
+}
+
+func getWriteRequest() *writeRequest {
+	return writeRequestPool.Get().(*writeRequest)
+}
+
+func putWriteRequest(r *writeRequest) {
+	r.msg = nil
+	writeRequestPool.Put(r)
+}
@@ -0,0 +1,55 @@
+package boxtransport
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWriteCloseRace hammers Write from many goroutines while Close
+// fires concurrently, on both BoxConns. Close used to race with
+// streamWriter's handling of the pooled *writeRequest it was mid-copy
+// on: Write's defer returned a *writeRequest to the pool the instant
+// its own select woke on <-c.done, even though streamWriter could
+// still be reading/writing req.msg at that very moment, so a new Write
+// could be handed the same pooled request while the old streamWriter
+// goroutine was still mutating it. Write and streamWriter now agree
+// that only streamWriter recycles a request, and only once it's truly
+// finished with it. Run with -race.
+func TestWriteCloseRace(t *testing.T) {
+	const goroutines = 16
+
+	for iter := 0; iter < 20; iter++ {
+		client, server := benchmarkPair(&testing.B{})
+		defer server.Close()
+
+		// Drain whatever the writers manage to send so Write isn't
+		// stuck waiting on buffer/window space rather than racing Close.
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				if _, err := server.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+
+		var wg sync.WaitGroup
+		wg.Add(goroutines)
+		for g := 0; g < goroutines; g++ {
+			go func() {
+				defer wg.Done()
+				payload := make([]byte, 256)
+				for {
+					if _, err := client.Write(payload); err != nil {
+						return
+					}
+				}
+			}()
+		}
+
+		time.Sleep(time.Millisecond)
+		client.Close()
+		wg.Wait()
+	}
+}
@@ -1,11 +1,11 @@
 package boxtransport
 
 import (
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
-	"golang.org/x/crypto/nacl/box"
 	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 /*
@@ -18,18 +18,28 @@ type writeRequest struct {
 	n   chan int
 }
 
-// Frames raw data and writes to socket
+// Frames raw data and writes to socket. Every msg it receives came
+// from a pooled frame buffer (seal, via WriteFrame or streamWriter),
+// so once it's been copied into tmp it's released back to the pool.
 func (c *BoxConn) boxWriter() {
+	defer c.wg.Done()
 	tmp := make([]byte, MaxRawData+LenFieldSize)
-	for msg, ok := <-c.outBox; ok; msg, ok = <-c.outBox {
+	for {
+		var msg []byte
+		select {
+		case msg = <-c.outBox:
+		case <-c.done:
+			return
+		}
 		size := len(msg)
 		tmp = tmp[:size+LenFieldSize]
 		binary.BigEndian.PutUint16(tmp[:LenFieldSize], uint16(size))
 		copy(tmp[LenFieldSize:], msg)
+		putFrameBuffer(msg)
 		for left := tmp; len(left) > 0; {
 			n, err := c.conn.Write(left)
 			if err != nil {
-				c.errors <- err
+				c.fail(err)
 				return
 			}
 			left = left[n:]
@@ -37,23 +47,29 @@ func (c *BoxConn) boxWriter() {
 	}
 }
 
-// Reads from socket and extracts raw data from frames
+// Reads from socket and extracts raw data from frames. Each delivered
+// frame is a pooled buffer; the caller releases it via ReleaseFrame
+// once done (ReadFrame's callers do this directly, Read does it for
+// them after copying into the user's slice).
 func (c *BoxConn) boxReader() {
+	defer c.wg.Done()
 	buff := make([]byte, MaxRawData+LenFieldSize)
 	buffSize := 0
-	defer func() {
-		recover()
-	}()
 	for {
 		// Extract data
 		if buffSize >= LenFieldSize {
 			frameSize := int(binary.BigEndian.Uint16(buff[:])) + LenFieldSize
 			if buffSize >= frameSize {
-				tmp := make([]byte, frameSize-LenFieldSize)
+				tmp := getFrameBuffer()[:frameSize-LenFieldSize]
 				copy(tmp, buff[LenFieldSize:frameSize])
 				copy(buff, buff[frameSize:buffSize])
 				buffSize -= frameSize
-				c.inBox <- tmp
+				select {
+				case c.inBox <- tmp:
+				case <-c.done:
+					putFrameBuffer(tmp)
+					return
+				}
 				continue
 			}
 		}
@@ -62,7 +78,7 @@ func (c *BoxConn) boxReader() {
 		n, err := c.conn.Read(buff[buffSize:])
 		buffSize += n
 		if err != nil {
-			c.errors <- err
+			c.fail(err)
 			return
 		}
 	}
@@ -70,46 +86,78 @@ func (c *BoxConn) boxReader() {
 
 // Adds opportunistic buffering to boxWriter
 func (c *BoxConn) streamWriter() {
+	defer c.wg.Done()
 	frameSize := 0
 	frame := make([]byte, MaxContent)
 	var encMsg []byte
 	var err error
-	var ok bool
 	var req *writeRequest
-	defer func() {
-		recover()
-	}()
 	for {
 		// Read next request or attempt socket write
 		if req == nil && len(encMsg) != 0 {
 			select {
-			case req, ok = <-c.outStream:
-				if !ok {
+			case req = <-c.outStream:
+				// encMsg has already spent a tx nonce, so it must go out
+				// before anything else is sealed; flush it rather than
+				// merging req into the frame and sealing again.
+				select {
+				case c.outBox <- encMsg:
+					encMsg = nil
+					frameSize = 0
+				case <-c.done:
 					return
 				}
 			case c.outBox <- encMsg:
 				encMsg = nil
 				frameSize = 0
+			case <-c.done:
+				return
 			}
 		} else if len(encMsg) != 0 {
-			c.outBox <- encMsg
-			encMsg = nil
-			frameSize = 0
+			select {
+			case c.outBox <- encMsg:
+				encMsg = nil
+				frameSize = 0
+			case <-c.done:
+				return
+			}
 		} else {
-			req, ok = <-c.outStream
-			if !ok {
+			select {
+			case req = <-c.outStream:
+			case <-c.done:
 				return
 			}
 		}
 
-		// Copy data into frame
+		// Copy data into frame. req.n is signalled last, once every
+		// field of req has been touched for the final time: Write
+		// returns the instant it reads req.n, so writing to
+		// req.msg/frameSize afterwards would race Write reading them.
+		// The send itself also races Close, since a Write that gave up
+		// on done no longer has anyone reading req.n.
+		//
+		// Write no longer recycles req itself: once it has been handed
+		// to us over outStream, only we know when we're truly done
+		// touching it, so only we return it to the pool (when done is
+		// true, i.e. exactly once Write's loop can no longer be
+		// expecting more from it). If we give up via done first, we
+		// just drop req instead of pooling it, since Write may still
+		// be reading req.n concurrently in that race and a pooled
+		// *writeRequest handed to a new Write while this one still
+		// references it would be a use-after-free.
 		if req != nil && MaxContent-frameSize > 0 {
 			n := copy(frame[frameSize:], req.msg)
-			req.n <- n
 			req.msg = req.msg[n:]
 			frameSize += n
 			encMsg = nil
-			if len(req.msg) == 0 {
+			done := len(req.msg) == 0
+			select {
+			case req.n <- n:
+			case <-c.done:
+				return
+			}
+			if done {
+				putWriteRequest(req)
 				req = nil
 			}
 		}
@@ -129,30 +177,72 @@ func (c *BoxConn) streamWriter() {
 		if frameSize > 0 && encMsg == nil {
 			encMsg, err = c.seal(frame[:frameSize])
 			if err != nil {
-				c.errors <- err
+				c.fail(err)
 				return
 			}
 		}
 	}
 }
 
-// Seals data
+// Seals data using the per-direction transport key and a strictly
+// increasing 64-bit nonce counter that is never sent on the wire: the
+// receiver tracks the same counter on its rx side, so nonces never
+// collide and a frame can never be replayed into a later position in
+// the stream without failing to authenticate. Rekeys the tx key once
+// rekeyInterval frames have been sealed under it.
 func (c *BoxConn) seal(b []byte) ([]byte, error) {
-	var nonce [NonceSize]byte
-	n, err := rand.Read(nonce[:])
-	if err != nil || n != NonceSize {
-		return nil, errors.New("Failed to generate nonce")
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+
+	aead, err := chacha20poly1305.New(c.tx[:])
+	if err != nil {
+		return nil, err
 	}
-	return box.SealAfterPrecomputation(nonce[:], b, &nonce, c.sharedSecret), nil
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], c.txNonce)
+	c.txNonce++
+
+	out := aead.Seal(getFrameBuffer(), nonce[:], b, nil)
+
+	c.txFrames++
+	if c.rekeyInterval > 0 && c.txFrames >= c.rekeyInterval {
+		c.tx = rekeyBlake2s(c.tx)
+		c.txNonce = 0
+		c.txFrames = 0
+	}
+	return out, nil
 }
 
-// Unseals and verifies data
+// Unseals and verifies data in place, reusing b's backing array for
+// the plaintext so a pooled ciphertext buffer (from boxReader) simply
+// becomes the pooled plaintext buffer the caller releases. The nonce
+// isn't carried on the wire: it is this side's own strictly increasing
+// counter, so an out-of-order or replayed frame simply fails AEAD
+// authentication instead of silently decrypting under the wrong
+// nonce. Rekeys the rx key once rekeyInterval frames have been
+// unsealed under it.
 func (c *BoxConn) unseal(b []byte) ([]byte, error) {
-	var nonce [NonceSize]byte
-	copy(nonce[:], b[:NonceSize])
-	plain, valid := box.OpenAfterPrecomputation(nil, b[NonceSize:], &nonce, c.sharedSecret)
-	if !valid {
+	c.rxMu.Lock()
+	defer c.rxMu.Unlock()
+
+	aead, err := chacha20poly1305.New(c.rx[:])
+	if err != nil {
+		return nil, err
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], c.rxNonce)
+
+	plain, err := aead.Open(b[:0], nonce[:], b, nil)
+	if err != nil {
 		return nil, errors.New("Recieved invalid box")
 	}
+	c.rxNonce++
+
+	c.rxFrames++
+	if c.rekeyInterval > 0 && c.rxFrames >= c.rekeyInterval {
+		c.rx = rekeyBlake2s(c.rx)
+		c.rxNonce = 0
+		c.rxFrames = 0
+	}
 	return plain, nil
 }